@@ -0,0 +1,136 @@
+package httpd
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v14/arrow"
+	"github.com/apache/arrow/go/v14/arrow/array"
+	"github.com/apache/arrow/go/v14/arrow/memory"
+	"github.com/influxdata/influxdb/models"
+)
+
+func TestArrowColumnType(t *testing.T) {
+	tests := []struct {
+		name   string
+		series []*models.Row
+		col    int
+		want   arrow.DataType
+	}{
+		{
+			name:   "float64",
+			series: []*models.Row{{Columns: []string{"time", "value"}, Values: [][]interface{}{{time.Unix(0, 0), 1.5}}}},
+			col:    1,
+			want:   arrow.PrimitiveTypes.Float64,
+		},
+		{
+			name:   "int64",
+			series: []*models.Row{{Columns: []string{"time", "value"}, Values: [][]interface{}{{time.Unix(0, 0), int64(42)}}}},
+			col:    1,
+			want:   arrow.PrimitiveTypes.Int64,
+		},
+		{
+			name:   "bool",
+			series: []*models.Row{{Columns: []string{"time", "ok"}, Values: [][]interface{}{{time.Unix(0, 0), true}}}},
+			col:    1,
+			want:   arrow.FixedWidthTypes.Boolean,
+		},
+		{
+			name:   "time",
+			series: []*models.Row{{Columns: []string{"time"}, Values: [][]interface{}{{time.Unix(0, 0)}}}},
+			col:    0,
+			want:   &arrow.TimestampType{Unit: arrow.Nanosecond, TimeZone: "UTC"},
+		},
+		{
+			name:   "short string",
+			series: []*models.Row{{Columns: []string{"host"}, Values: [][]interface{}{{"server01"}}}},
+			col:    0,
+			want:   arrow.BinaryTypes.String,
+		},
+		{
+			name:   "long string promoted to LargeString",
+			series: []*models.Row{{Columns: []string{"body"}, Values: [][]interface{}{{strings.Repeat("x", largeUtf8Threshold+1)}}}},
+			col:    0,
+			want:   arrow.BinaryTypes.LargeString,
+		},
+		{
+			name:   "all nil defaults to string",
+			series: []*models.Row{{Columns: []string{"value"}, Values: [][]interface{}{{nil}}}},
+			col:    0,
+			want:   arrow.BinaryTypes.String,
+		},
+		{
+			name: "int64 in one series and float64 in another widens to Float64",
+			series: []*models.Row{
+				{Columns: []string{"value"}, Values: [][]interface{}{{int64(1)}}},
+				{Columns: []string{"value"}, Values: [][]interface{}{{2.5}}},
+			},
+			col:  0,
+			want: arrow.PrimitiveTypes.Float64,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := arrowColumnType(tt.series, tt.col)
+			if !arrow.TypeEqual(got, tt.want) {
+				t.Errorf("arrowColumnType() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArrowSchema(t *testing.T) {
+	series := &models.Row{
+		Name:    "cpu",
+		Tags:    map[string]string{"region": "us-west", "host": "server01"},
+		Columns: []string{"time", "value"},
+		Values:  [][]interface{}{{time.Unix(0, 0), 1.5}},
+	}
+
+	schema := arrowSchema([]*models.Row{series})
+
+	// name, then tags in sorted key order (host before region), then the
+	// value columns in their original order.
+	want := []string{"name", "tag.host", "tag.region", "time", "value"}
+	if schema.NumFields() != len(want) {
+		t.Fatalf("schema has %d fields, want %d", schema.NumFields(), len(want))
+	}
+	for i, name := range want {
+		if got := schema.Field(i).Name; got != name {
+			t.Errorf("field %d = %q, want %q", i, got, name)
+		}
+	}
+}
+
+// TestArrowRecord_mixedSeriesTypes covers the fix for a panic:
+// arrowRecord used to type-assert each value directly against the
+// builder arrowSchema picked from the first series, so a later series
+// whose same-named column held a different (but schema-compatible,
+// post-widening) concrete type crashed instead of being converted.
+func TestArrowRecord_mixedSeriesTypes(t *testing.T) {
+	allSeries := []*models.Row{
+		{Name: "cpu", Columns: []string{"value"}, Values: [][]interface{}{{int64(1)}}},
+		{Name: "cpu", Columns: []string{"value"}, Values: [][]interface{}{{2.5}}},
+	}
+	schema := arrowSchema(allSeries)
+
+	alloc := memory.NewGoAllocator()
+	for _, series := range allSeries {
+		rec, err := arrowRecord(alloc, schema, series, 0, len(series.Values))
+		if err != nil {
+			t.Fatalf("arrowRecord() error = %v", err)
+		}
+		rec.Release()
+	}
+}
+
+func TestAppendArrowValue_typeMismatchReturnsError(t *testing.T) {
+	b := array.NewInt64Builder(memory.NewGoAllocator())
+	defer b.Release()
+
+	if err := appendArrowValue(b, "not an int64"); err == nil {
+		t.Fatal("appendArrowValue() error = nil, want a type mismatch error")
+	}
+}
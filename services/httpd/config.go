@@ -0,0 +1,66 @@
+package httpd
+
+// Config aggregates the ResponseWriter tunables that NewResponseWriter
+// and friends need: which Accept-Encoding codecs to negotiate, how often
+// a streaming writer flushes, how the Arrow format batches rows, and how
+// write-deadline handling behaves. Callers typically carry one of these
+// on their handler's own HTTPConfig and thread it through on each
+// request.
+type Config struct {
+	Encoding EncodingConfig
+
+	// Stream controls the flush cadence of chunked (chunked=true) query
+	// requests. For JSON and CSV, chunking changes only when bytes reach
+	// the client, not their shape: the body is still one document, the
+	// same one WriteResponse would have produced. For msgpack it's a
+	// wire-format change, not just a flush-cadence one: because
+	// msgpack's array/map headers are length-prefixed (see
+	// msgpackResponseWriter.WriteResponseStream), a chunked msgpack
+	// response is a sequence of independent top-level Result values
+	// back-to-back on the connection, rather than the single top-level
+	// {"results": [...]}-shaped map WriteResponse emits. A chunked
+	// msgpack client has to decode in a loop until the connection
+	// closes; decoding it like a non-chunked response will only see the
+	// first statement.
+	Stream StreamConfig
+
+	Arrow   ArrowConfig
+	Timeout TimeoutConfig
+
+	// BufferSize is the size, in bytes, of the per-connection output
+	// buffer that jsonResponseWriter, csvResponseWriter and
+	// msgpackResponseWriter all write through, so that a large response
+	// is sent as a handful of large write(2) calls instead of one per
+	// row or field.
+	BufferSize int `toml:"response-buffer-size"`
+
+	// Trailers declares the Influx-Query-Error, Influx-Rows-Written and
+	// Influx-Statement-Errors HTTP/2 trailers up front and has each
+	// ResponseWriter populate them in Finalize, so a client can learn a
+	// multi-statement query's outcome without waiting to parse the body.
+	Trailers bool `toml:"trailers"`
+
+	// Push enables server-push, on HTTP/2 connections that support it,
+	// of a SHOW FIELD KEYS companion request for each measurement in the
+	// primary query. See PushFieldKeys.
+	Push bool `toml:"push"`
+}
+
+// defaultBufferSize is 32KiB, a step up from bufio's own 4KiB default
+// and a reasonable default for the bulk query results this buffer
+// mostly exists for. Operators streaming very large results can raise it
+// with Config.BufferSize (response-buffer-size, e.g. to 1M).
+const defaultBufferSize = 32 * 1024
+
+// NewConfig returns the package defaults for every sub-config.
+func NewConfig() Config {
+	return Config{
+		Encoding:   NewEncodingConfig(),
+		Stream:     NewStreamConfig(),
+		Arrow:      NewArrowConfig(),
+		Timeout:    NewTimeoutConfig(),
+		BufferSize: defaultBufferSize,
+		Trailers:   true,
+		Push:       true,
+	}
+}
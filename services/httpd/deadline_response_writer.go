@@ -0,0 +1,174 @@
+package httpd
+
+import (
+	"context"
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// TimeoutConfig controls how NewResponseWriterWithDeadline reacts when a
+// response is still being written as the server's write deadline
+// approaches.
+type TimeoutConfig struct {
+	// WriteTimeout is the server's overall HTTP write timeout. Zero means
+	// the server has none configured, in which case only a per-request
+	// "timeout" query parameter (if present) applies.
+	WriteTimeout time.Duration `toml:"write-timeout"`
+
+	// Margin is how long before WriteTimeout (or the request's own
+	// ?timeout=) the internal deadline fires, leaving time to flush a
+	// well-formed error terminator before the socket's own deadline does.
+	Margin time.Duration `toml:"write-timeout-margin"`
+}
+
+// NewTimeoutConfig returns the package default: no server write timeout
+// and a half-second margin.
+func NewTimeoutConfig() TimeoutConfig {
+	return TimeoutConfig{Margin: 500 * time.Millisecond}
+}
+
+// deadline returns how long a response to r may take before
+// NewResponseWriterWithDeadline cuts it short, honoring a per-request
+// "timeout" query parameter if it is stricter than cfg.WriteTimeout. It
+// returns 0 if neither applies.
+func (cfg TimeoutConfig) deadline(r *http.Request) time.Duration {
+	d := cfg.WriteTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		if qd, err := time.ParseDuration(v); err == nil && (d <= 0 || qd < d) {
+			d = qd
+		}
+	}
+	if d <= 0 {
+		return 0
+	}
+	if d -= cfg.Margin; d <= 0 {
+		d = time.Millisecond
+	}
+	return d
+}
+
+// deadlineResponseWriter buffers the entire response body in memory
+// instead of writing through to the socket. This is what makes it safe
+// to discard and replace the body if the write deadline fires mid-
+// response: nothing has reached the client yet, so the partial buffer
+// can be thrown away and replaced with a complete, well-formed error
+// document with a known Content-Length, rather than the client seeing a
+// truncated one. Chunked transfer-encoding is implicitly disabled by
+// buffering; content-encoding (whose final length can't be predicted
+// before the body is complete) is left off by NewResponseWriterWithDeadline,
+// which negotiates none.
+type deadlineResponseWriter struct {
+	http.ResponseWriter
+	buf []byte
+}
+
+func (w *deadlineResponseWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+// Flush is a no-op: nothing reaches the socket until finalize.
+func (w *deadlineResponseWriter) Flush() {}
+
+// finalize sets Content-Length from the buffered body and writes it
+// through to the underlying http.ResponseWriter, then flushes it if it
+// is an http.Flusher.
+func (w *deadlineResponseWriter) finalize() {
+	w.Header().Set("Content-Length", strconv.Itoa(len(w.buf)))
+	w.ResponseWriter.Write(w.buf)
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// bufferedResponseWriter is implemented by the jsonResponseWriter/
+// csvResponseWriter/msgpackResponseWriter writers NewResponseWriterWithConfig
+// returns, each of which passes Write calls through a *bufio.Writer
+// before they reach the underlying ResponseWriter (here, a
+// deadlineResponseWriter). finalize's error path uses resetBuf to drop
+// whatever of the in-flight response is still sitting unflushed in that
+// bufio.Writer before writing the error terminator, so the terminator
+// replaces the partial response instead of being appended after it.
+type bufferedResponseWriter interface {
+	resetBuf()
+}
+
+// errorTerminator is implemented by ResponseWriters that can emit a
+// trailing, well-formed error marker for a response being cut short
+// (e.g. by a write deadline), as opposed to the top-level Err field that
+// WriteResponse already renders for a response that errors before any
+// output has been produced.
+type errorTerminator interface {
+	WriteErrorTerminator(err error) (int, error)
+}
+
+func (w *jsonResponseWriter) WriteErrorTerminator(err error) (int, error) {
+	return w.WriteResponse(Response{Err: err})
+}
+
+func (w *msgpackResponseWriter) WriteErrorTerminator(err error) (int, error) {
+	return w.WriteResponse(Response{Err: err})
+}
+
+// WriteErrorTerminator emits a one-row CSV document - a header of
+// "error" followed by the message - since the CSV format has no
+// top-level object to attach an Err field to the way JSON and msgpack
+// do.
+func (w *csvResponseWriter) WriteErrorTerminator(err error) (n int, werr error) {
+	csvw := csv.NewWriter(writer{Writer: w, n: &n})
+	if werr = csvw.Write([]string{"error"}); werr != nil {
+		return n, werr
+	}
+	if werr = csvw.Write([]string{err.Error()}); werr != nil {
+		return n, werr
+	}
+	csvw.Flush()
+	return n, csvw.Error()
+}
+
+// NewResponseWriterWithDeadline wraps NewResponseWriterWithConfig so
+// that a response still being written when cfg.Timeout's deadline (see
+// TimeoutConfig.deadline) elapses is cut short cleanly: the caller
+// should watch ctx.Done(), stop iterating its result set, and call
+// finalize with the context's error so a well-formed error terminator
+// replaces whatever had been buffered so far.
+//
+// Content-encoding is not negotiated for the deadline-aware writer,
+// since a compressed Content-Length can't be known before the body is
+// complete, which buffering this writer requires anyway.
+func NewResponseWriterWithDeadline(w http.ResponseWriter, r *http.Request, cfg Config) (rw ResponseWriter, ctx context.Context, finalize func(err error)) {
+	dw := &deadlineResponseWriter{ResponseWriter: w}
+	rw = NewResponseWriterWithConfig(dw, r, Config{Arrow: cfg.Arrow})
+
+	var cancel context.CancelFunc
+	if d := cfg.Timeout.deadline(r); d > 0 {
+		ctx, cancel = context.WithTimeout(r.Context(), d)
+	} else {
+		ctx, cancel = context.WithCancel(r.Context())
+	}
+
+	finalize = func(err error) {
+		defer cancel()
+		if err != nil {
+			dw.buf = dw.buf[:0]
+			if bw, ok := rw.(bufferedResponseWriter); ok {
+				bw.resetBuf()
+			}
+			if et, ok := rw.(errorTerminator); ok {
+				et.WriteErrorTerminator(err)
+			}
+		}
+		// rw wraps dw in a bufio.Writer (see newJSONResponseWriter et
+		// al.), which only drains into dw.buf on an explicit Flush or
+		// once its own buffer fills. Without this, dw.buf - and
+		// therefore both Content-Length and the body - stays empty for
+		// any response smaller than that buffer, on both branches above.
+		if f, ok := rw.(http.Flusher); ok {
+			f.Flush()
+		}
+		dw.finalize()
+	}
+	return rw, ctx, finalize
+}
@@ -0,0 +1,95 @@
+package httpd
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeoutConfig_deadline(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   TimeoutConfig
+		query string
+		want  time.Duration
+	}{
+		{
+			name: "no timeout configured",
+			cfg:  TimeoutConfig{},
+			want: 0,
+		},
+		{
+			name: "write timeout minus margin",
+			cfg:  TimeoutConfig{WriteTimeout: 10 * time.Second, Margin: 2 * time.Second},
+			want: 8 * time.Second,
+		},
+		{
+			name:  "request timeout overrides a looser write timeout",
+			cfg:   TimeoutConfig{WriteTimeout: 10 * time.Second, Margin: time.Second},
+			query: "timeout=3s",
+			want:  2 * time.Second,
+		},
+		{
+			name:  "request timeout ignored when stricter write timeout applies",
+			cfg:   TimeoutConfig{WriteTimeout: 1 * time.Second, Margin: 100 * time.Millisecond},
+			query: "timeout=10s",
+			want:  900 * time.Millisecond,
+		},
+		{
+			name:  "malformed request timeout ignored",
+			cfg:   TimeoutConfig{WriteTimeout: 5 * time.Second, Margin: time.Second},
+			query: "timeout=notaduration",
+			want:  4 * time.Second,
+		},
+		{
+			name: "margin would make deadline non-positive, floored to 1ms",
+			cfg:  TimeoutConfig{WriteTimeout: time.Second, Margin: 2 * time.Second},
+			want: time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := "/query"
+			if tt.query != "" {
+				url += "?" + tt.query
+			}
+			r := httptest.NewRequest(http.MethodGet, url, nil)
+			if got := tt.cfg.deadline(r); got != tt.want {
+				t.Errorf("deadline() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestNewResponseWriterWithDeadline_finalizeDiscardsUnflushedOutput covers
+// the fix for a bug where finalize's error path cleared
+// deadlineResponseWriter.buf but left whatever the in-flight response had
+// already written sitting unflushed in rw's wrapping *bufio.Writer, so
+// the error terminator was appended after that stale fragment instead of
+// replacing it.
+func TestNewResponseWriterWithDeadline_finalizeDiscardsUnflushedOutput(t *testing.T) {
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/query", nil)
+
+	rw, _, finalize := NewResponseWriterWithDeadline(rec, r, NewConfig())
+
+	// Simulate a partial write that never got flushed before the
+	// deadline fired - it should never reach the client.
+	if _, err := rw.Write([]byte(`{"results":[{"stale":"fragment"`)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	finalize(errors.New("write timeout"))
+
+	body := rec.Body.String()
+	if strings.Contains(body, "stale") || strings.Contains(body, "fragment") {
+		t.Fatalf("body contains the stale unflushed fragment: %q", body)
+	}
+	if !strings.Contains(body, "write timeout") {
+		t.Fatalf("body does not contain the error terminator: %q", body)
+	}
+}
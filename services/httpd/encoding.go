@@ -0,0 +1,384 @@
+package httpd
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported content-codings for the Accept-Encoding negotiation performed
+// by NewResponseWriter.
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+	encodingZstd    = "zstd"
+	encodingBrotli  = "br"
+)
+
+// EncodingConfig controls which content-codings NewResponseWriter will
+// negotiate with a client via its Accept-Encoding header, and the
+// server's preference among them when a client accepts more than one.
+type EncodingConfig struct {
+	// Preference lists the enabled codecs in the server's preferred
+	// order. The first entry that the client also accepts wins.
+	Preference []string `toml:"preference"`
+
+	GZIP    bool `toml:"gzip"`
+	Deflate bool `toml:"deflate"`
+	Zstd    bool `toml:"zstd"`
+	Brotli  bool `toml:"brotli"`
+
+	// GZIPLevel is passed to gzip.NewWriterLevel.
+	GZIPLevel int `toml:"gzip-level"`
+
+	// MinContentLength is the smallest response, in bytes, that will be
+	// compressed. Responses smaller than this are written uncompressed
+	// to avoid paying codec overhead on a handful of bytes.
+	MinContentLength int `toml:"min-content-length"`
+}
+
+// NewEncodingConfig returns the package defaults: gzip and deflate
+// enabled, zstd and brotli disabled, a 1400 byte (typical MTU) threshold,
+// and gzip's default compression level.
+func NewEncodingConfig() EncodingConfig {
+	return EncodingConfig{
+		Preference:       []string{encodingBrotli, encodingZstd, encodingGzip, encodingDeflate},
+		GZIP:             true,
+		Deflate:          true,
+		GZIPLevel:        gzip.DefaultCompression,
+		MinContentLength: 1400,
+	}
+}
+
+func (c EncodingConfig) enabled(name string) bool {
+	switch name {
+	case encodingGzip:
+		return c.GZIP
+	case encodingDeflate:
+		return c.Deflate
+	case encodingZstd:
+		return c.Zstd
+	case encodingBrotli:
+		return c.Brotli
+	default:
+		return false
+	}
+}
+
+// negotiateEncoding selects the best content-coding for r given cfg, or
+// "" if the response should be sent uncompressed.
+func negotiateEncoding(r *http.Request, cfg EncodingConfig) string {
+	h := r.Header.Get("Accept-Encoding")
+	accept := parseAcceptEncoding(h)
+	if len(accept) == 0 {
+		return ""
+	}
+
+	for _, name := range cfg.Preference {
+		if !cfg.enabled(name) {
+			continue
+		}
+		if q, ok := accept[name]; ok && q > 0 {
+			return name
+		}
+	}
+
+	// A client offering "*" accepts any coding not explicitly listed.
+	// parseAcceptEncoding drops codings listed with q=0, so the raw
+	// header is checked for which codings were named at all.
+	if q, ok := accept["*"]; ok && q > 0 {
+		listed := make(map[string]bool)
+		for _, part := range strings.Split(h, ",") {
+			name := part
+			if i := strings.IndexByte(part, ';'); i >= 0 {
+				name = part[:i]
+			}
+			listed[strings.ToLower(strings.TrimSpace(name))] = true
+		}
+		for _, name := range cfg.Preference {
+			if !listed[name] && cfg.enabled(name) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// parseAcceptEncoding parses an Accept-Encoding header into a map of
+// content-coding to quality value. Codings with a q of 0 are dropped.
+func parseAcceptEncoding(h string) map[string]float64 {
+	if h == "" {
+		return nil
+	}
+
+	accept := make(map[string]float64)
+	for _, part := range strings.Split(h, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, q := part, 1.0
+		if i := strings.IndexByte(part, ';'); i >= 0 {
+			name = strings.TrimSpace(part[:i])
+			if j := strings.Index(part[i:], "q="); j >= 0 {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(part[i+j+2:]), 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			accept[strings.ToLower(name)] = q
+		}
+	}
+	return accept
+}
+
+// compressWriter wraps a pooled codec encoder so it can be flushed and
+// closed uniformly regardless of which content-coding was negotiated.
+type compressWriter struct {
+	io.Writer
+	flush func() error
+	close func() error
+}
+
+func (w *compressWriter) Flush() error { return w.flush() }
+func (w *compressWriter) Close() error { return w.close() }
+
+var gzipWriterPools sync.Map // level (int) -> *sync.Pool of *gzip.Writer
+
+func gzipPool(level int) *sync.Pool {
+	if p, ok := gzipWriterPools.Load(level); ok {
+		return p.(*sync.Pool)
+	}
+	p := &sync.Pool{New: func() interface{} {
+		zw, _ := gzip.NewWriterLevel(io.Discard, level)
+		return zw
+	}}
+	actual, _ := gzipWriterPools.LoadOrStore(level, p)
+	return actual.(*sync.Pool)
+}
+
+var deflateWriterPool = sync.Pool{New: func() interface{} {
+	zw, _ := flate.NewWriter(io.Discard, flate.DefaultCompression)
+	return zw
+}}
+
+var zstdEncoderPool = sync.Pool{New: func() interface{} {
+	zw, _ := zstd.NewWriter(io.Discard)
+	return zw
+}}
+
+var brotliWriterPool = sync.Pool{New: func() interface{} {
+	return brotli.NewWriter(io.Discard)
+}}
+
+// newCompressWriter returns a compressWriter for encoding that writes
+// into w, pulling its underlying codec from the relevant pool.
+func newCompressWriter(w io.Writer, encoding string, cfg EncodingConfig) *compressWriter {
+	switch encoding {
+	case encodingGzip:
+		pool := gzipPool(cfg.GZIPLevel)
+		zw := pool.Get().(*gzip.Writer)
+		zw.Reset(w)
+		return &compressWriter{
+			Writer: zw,
+			flush:  zw.Flush,
+			close: func() error {
+				err := zw.Close()
+				pool.Put(zw)
+				return err
+			},
+		}
+	case encodingDeflate:
+		zw := deflateWriterPool.Get().(*flate.Writer)
+		zw.Reset(w)
+		return &compressWriter{
+			Writer: zw,
+			flush:  zw.Flush,
+			close: func() error {
+				err := zw.Close()
+				deflateWriterPool.Put(zw)
+				return err
+			},
+		}
+	case encodingZstd:
+		zw := zstdEncoderPool.Get().(*zstd.Encoder)
+		zw.Reset(w)
+		return &compressWriter{
+			Writer: zw,
+			flush:  zw.Flush,
+			close: func() error {
+				err := zw.Close()
+				zstdEncoderPool.Put(zw)
+				return err
+			},
+		}
+	case encodingBrotli:
+		zw := brotliWriterPool.Get().(*brotli.Writer)
+		zw.Reset(w)
+		return &compressWriter{
+			Writer: zw,
+			flush:  zw.Flush,
+			close: func() error {
+				err := zw.Close()
+				brotliWriterPool.Put(zw)
+				return err
+			},
+		}
+	default:
+		panic("httpd: unsupported content-coding: " + encoding)
+	}
+}
+
+// encodingResponseWriter transparently compresses the body written to an
+// http.ResponseWriter with the content-coding negotiated by
+// negotiateEncoding. Writes are buffered until cfg.MinContentLength is
+// reached so that short responses are sent uncompressed; once the
+// threshold is crossed the buffered bytes and everything after are piped
+// through the chosen codec. If a caller Flushes before the threshold is
+// reached, the buffered bytes are committed uncompressed instead and
+// compression is permanently disabled for the rest of the response (see
+// passthrough).
+type encodingResponseWriter struct {
+	http.ResponseWriter
+
+	encoding string
+	cfg      EncodingConfig
+
+	cw      *compressWriter
+	buf     []byte
+	started bool
+
+	// passthrough is set once Flush has committed the header and any
+	// buffered bytes uncompressed because the MinContentLength threshold
+	// hadn't been reached yet. Per net/http, WriteHeader (called by
+	// commitHeader) freezes the header map, so start() can no longer set
+	// Content-Encoding on it afterwards - letting a later Write cross the
+	// threshold and compress the rest of the body would silently produce
+	// a response with no Content-Encoding header but a body that's raw
+	// bytes followed by compressed bytes. Once set, every later Write
+	// goes straight to the underlying ResponseWriter uncompressed.
+	passthrough bool
+
+	// statusCode is buffered rather than forwarded immediately: per
+	// net/http, the header map is frozen as soon as WriteHeader is
+	// called, and start() still needs to set Content-Encoding/Vary on it
+	// once the codec is chosen. 0 means WriteHeader was never called
+	// explicitly.
+	statusCode int
+}
+
+// newEncodingResponseWriter returns w wrapped with content-encoding
+// negotiation, or w itself if the client and server have no coding in
+// common.
+func newEncodingResponseWriter(w http.ResponseWriter, r *http.Request, cfg EncodingConfig) http.ResponseWriter {
+	encoding := negotiateEncoding(r, cfg)
+	if encoding == "" {
+		return w
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	return &encodingResponseWriter{ResponseWriter: w, encoding: encoding, cfg: cfg}
+}
+
+// WriteHeader buffers code instead of forwarding it immediately, so that
+// headers set later by start() still land before the status line (and
+// therefore the header map) is committed.
+func (w *encodingResponseWriter) WriteHeader(code int) {
+	w.statusCode = code
+}
+
+// commitHeader forwards a buffered WriteHeader call, if there was one,
+// now that every header mutation for this response has been made.
+func (w *encodingResponseWriter) commitHeader() {
+	if w.statusCode != 0 {
+		w.ResponseWriter.WriteHeader(w.statusCode)
+		w.statusCode = 0
+	}
+}
+
+func (w *encodingResponseWriter) Write(p []byte) (int, error) {
+	if w.passthrough {
+		return w.ResponseWriter.Write(p)
+	}
+	if w.started {
+		return w.cw.Write(p)
+	}
+	if len(w.buf)+len(p) < w.cfg.MinContentLength {
+		w.buf = append(w.buf, p...)
+		return len(p), nil
+	}
+	if err := w.start(); err != nil {
+		return 0, err
+	}
+	return w.cw.Write(p)
+}
+
+func (w *encodingResponseWriter) start() error {
+	w.started = true
+	w.Header().Set("Content-Encoding", w.encoding)
+	w.Header().Del("Content-Length")
+	w.commitHeader()
+	w.cw = newCompressWriter(w.ResponseWriter, w.encoding, w.cfg)
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.cw.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+// Flush flushes any buffered bytes and propagates through the codec and
+// the underlying http.Flusher, so chunked streaming of large responses
+// keeps working under compression. If the MinContentLength threshold
+// hasn't been reached yet, the buffered bytes are committed uncompressed
+// and passthrough is latched so the rest of the response stays
+// uncompressed too, instead of letting start() try to set
+// Content-Encoding on a header map Flush has already committed.
+func (w *encodingResponseWriter) Flush() {
+	switch {
+	case w.passthrough:
+		// Already committed uncompressed; nothing buffered to drain.
+	case !w.started:
+		w.commitHeader()
+		if len(w.buf) > 0 {
+			w.ResponseWriter.Write(w.buf)
+			w.buf = nil
+		}
+		w.passthrough = true
+	default:
+		w.cw.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finalizes the codec stream, emitting any trailing frame (gzip,
+// zstd and brotli all write a footer on Close), and returns the codec to
+// its pool. If the threshold was never crossed, it commits the header and
+// writes any buffered bytes uncompressed instead. It is a no-op if Flush
+// already latched passthrough.
+func (w *encodingResponseWriter) Close() error {
+	switch {
+	case w.passthrough:
+		return nil
+	case !w.started:
+		w.commitHeader()
+		if len(w.buf) > 0 {
+			_, err := w.ResponseWriter.Write(w.buf)
+			w.buf = nil
+			return err
+		}
+		return nil
+	default:
+		return w.cw.Close()
+	}
+}
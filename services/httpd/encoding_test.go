@@ -0,0 +1,152 @@
+package httpd
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		name string
+		hdr  string
+		want map[string]float64
+	}{
+		{name: "empty", hdr: "", want: nil},
+		{name: "single", hdr: "gzip", want: map[string]float64{"gzip": 1}},
+		{name: "multiple", hdr: "gzip, deflate", want: map[string]float64{"gzip": 1, "deflate": 1}},
+		{name: "quality", hdr: "gzip;q=0.5, br;q=1.0", want: map[string]float64{"gzip": 0.5, "br": 1}},
+		{name: "zero quality dropped", hdr: "gzip;q=0, deflate", want: map[string]float64{"deflate": 1}},
+		{name: "wildcard", hdr: "*;q=0.2", want: map[string]float64{"*": 0.2}},
+		{name: "mixed case", hdr: "GZIP", want: map[string]float64{"gzip": 1}},
+		{name: "whitespace", hdr: " gzip , deflate ", want: map[string]float64{"gzip": 1, "deflate": 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseAcceptEncoding(tt.hdr)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAcceptEncoding(%q) = %v, want %v", tt.hdr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	cfg := EncodingConfig{
+		Preference: []string{encodingBrotli, encodingZstd, encodingGzip, encodingDeflate},
+		GZIP:       true,
+		Deflate:    true,
+	}
+
+	tests := []struct {
+		name string
+		hdr  string
+		cfg  EncodingConfig
+		want string
+	}{
+		{name: "no header", hdr: "", cfg: cfg, want: ""},
+		{name: "prefers server order", hdr: "deflate, gzip", cfg: cfg, want: "gzip"},
+		{name: "disabled coding skipped", hdr: "br, gzip", cfg: cfg, want: "gzip"},
+		{name: "nothing enabled in common", hdr: "br, zstd", cfg: cfg, want: ""},
+		{name: "wildcard picks first enabled", hdr: "*", cfg: cfg, want: "gzip"},
+		{name: "explicit zero excludes even with wildcard", hdr: "*, gzip;q=0", cfg: cfg, want: "deflate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/query", nil)
+			if tt.hdr != "" {
+				r.Header.Set("Accept-Encoding", tt.hdr)
+			}
+			if got := negotiateEncoding(r, tt.cfg); got != tt.want {
+				t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.hdr, got, tt.want)
+			}
+		})
+	}
+}
+
+func newTestEncodingResponseWriter(rec *httptest.ResponseRecorder, minContentLength int) *encodingResponseWriter {
+	return &encodingResponseWriter{
+		ResponseWriter: rec,
+		encoding:       encodingGzip,
+		cfg:            EncodingConfig{GZIP: true, GZIPLevel: gzip.DefaultCompression, MinContentLength: minContentLength},
+	}
+}
+
+func TestEncodingResponseWriter_crossesThresholdInOneWrite(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := newTestEncodingResponseWriter(rec, 4)
+
+	body := []byte("more than four bytes")
+	if _, err := w.Write(body); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if got := rec.Header().Get("Content-Encoding"); got != encodingGzip {
+		t.Fatalf("Content-Encoding = %q, want %q", got, encodingGzip)
+	}
+
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("response body is not valid gzip: %v", err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("reading gzip body: %v", err)
+	}
+	if string(got) != string(body) {
+		t.Errorf("decompressed body = %q, want %q", got, body)
+	}
+}
+
+// TestEncodingResponseWriter_flushBelowThreshold covers the fix for a bug
+// where a Flush before MinContentLength was reached committed the
+// response uncompressed (correctly), but left started=false, so a later
+// Write that crossed the threshold called start() and set
+// Content-Encoding on a header map Flush had already committed - a no-op
+// per net/http - while still compressing the rest of the body. The
+// client ended up with an uncompressed-looking response whose body was
+// actually raw bytes followed by compressed bytes.
+func TestEncodingResponseWriter_flushBelowThreshold(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := newTestEncodingResponseWriter(rec, 1000)
+
+	first := []byte("short")
+	if _, err := w.Write(first); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	w.Flush()
+
+	if got := rec.Header().Get("Content-Encoding"); got != "" {
+		t.Fatalf("Content-Encoding = %q after an uncompressed Flush, want unset", got)
+	}
+
+	// This write alone would cross MinContentLength; without the
+	// passthrough latch it would wrongly start compressing from here.
+	second := make([]byte, 2000)
+	for i := range second {
+		second[i] = 'x'
+	}
+	if _, err := w.Write(second); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if got := rec.Header().Get("Content-Encoding"); got != "" {
+		t.Fatalf("Content-Encoding = %q after passthrough was latched, want unset", got)
+	}
+
+	want := string(first) + string(second)
+	if rec.Body.String() != want {
+		t.Errorf("body = %q, want %q (uncompressed throughout)", rec.Body.String(), want)
+	}
+}
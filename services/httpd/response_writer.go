@@ -25,21 +25,52 @@ type ResponseWriter interface {
 }
 
 // NewResponseWriter creates a new ResponseWriter based on the Accept header
-// in the request that wraps the ResponseWriter.
+// in the request that wraps the ResponseWriter. Content-encoding, Arrow
+// batch size, and the other tunables are all taken from the package
+// defaults; use NewResponseWriterWithConfig to control them.
 func NewResponseWriter(w http.ResponseWriter, r *http.Request) ResponseWriter {
+	return NewResponseWriterWithConfig(w, r, NewConfig())
+}
+
+// NewResponseWriterWithConfig is like NewResponseWriter but negotiates
+// Accept-Encoding and builds the Arrow writer (if that format is
+// requested) against cfg instead of the package defaults, so callers can
+// enable or disable individual codecs or change Arrow's batch size (e.g.
+// via an HTTPConfig option).
+//
+// The returned ResponseWriter may also implement io.Closer; callers
+// should close it after the last call to WriteResponse to flush and
+// finalize any negotiated content-encoding.
+func NewResponseWriterWithConfig(w http.ResponseWriter, r *http.Request, cfg Config) ResponseWriter {
+	w = newEncodingResponseWriter(w, r, cfg.Encoding)
+
+	bufSize := cfg.BufferSize
+	if bufSize <= 0 {
+		bufSize = defaultBufferSize
+	}
+
+	stats := &responseStats{}
+	if cfg.Trailers {
+		declareTrailers(w)
+		stats.w = w
+	}
+
 	pretty := r.URL.Query().Get("pretty") == "true"
-	switch r.Header.Get("Accept") {
+	switch accept := r.Header.Get("Accept"); accept {
 	case "application/csv", "text/csv":
 		w.Header().Add("Content-Type", "text/csv")
-		return &csvResponseWriter{statementID: -1, ResponseWriter: w}
+		return newCSVResponseWriter(w, bufSize, stats)
 	case "application/x-msgpack":
 		w.Header().Add("Content-Type", "application/x-msgpack")
-		return newMsgpackResponseWriter(w)
+		return newMsgpackResponseWriter(w, bufSize, stats)
+	case arrowStreamMIMEType, arrowFileMIMEType:
+		w.Header().Add("Content-Type", accept)
+		return newArrowResponseWriter(w, accept == arrowFileMIMEType, cfg.Arrow, stats)
 	case "application/json":
 		fallthrough
 	default:
 		w.Header().Add("Content-Type", "application/json")
-		return &jsonResponseWriter{Pretty: pretty, ResponseWriter: w}
+		return newJSONResponseWriter(w, pretty, bufSize, stats)
 	}
 }
 
@@ -50,10 +81,31 @@ func WriteError(w ResponseWriter, err error) (int, error) {
 
 type jsonResponseWriter struct {
 	Pretty bool
+	buf    *bufio.Writer
+	stats  *responseStats
 	http.ResponseWriter
 }
 
+// newJSONResponseWriter returns a jsonResponseWriter whose writes pass
+// through a bufio.Writer of the given size rather than going straight to
+// the socket.
+func newJSONResponseWriter(w http.ResponseWriter, pretty bool, bufSize int, stats *responseStats) *jsonResponseWriter {
+	return &jsonResponseWriter{Pretty: pretty, ResponseWriter: w, buf: bufio.NewWriterSize(w, bufSize), stats: stats}
+}
+
+// Finalize sets the Influx-Query-Error/Rows-Written/Statement-Errors
+// trailers from the stats accumulated while writing the response.
+func (w *jsonResponseWriter) Finalize() { w.stats.Finalize() }
+
+// Write writes through the output buffer instead of straight to the
+// socket; call Flush to drain it.
+func (w *jsonResponseWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
 func (w *jsonResponseWriter) WriteResponse(resp Response) (n int, err error) {
+	w.stats.observe(resp)
+
 	var b []byte
 	if w.Pretty {
 		b, err = json.MarshalIndent(resp, "", "    ")
@@ -72,20 +124,57 @@ func (w *jsonResponseWriter) WriteResponse(resp Response) (n int, err error) {
 	return n, err
 }
 
-// Flush flushes the ResponseWriter if it has a Flush() method.
+// Flush drains the output buffer and then flushes the underlying
+// ResponseWriter if it has a Flush() method.
 func (w *jsonResponseWriter) Flush() {
+	w.buf.Flush()
 	if w, ok := w.ResponseWriter.(http.Flusher); ok {
 		w.Flush()
 	}
 }
 
+// Close finalizes the ResponseWriter if it has a Close() method, e.g. to
+// flush a negotiated content-encoding's trailing frame.
+func (w *jsonResponseWriter) Close() error {
+	if w, ok := w.ResponseWriter.(io.Closer); ok {
+		return w.Close()
+	}
+	return nil
+}
+
+// resetBuf discards whatever this response has written but not yet
+// flushed, rather than letting it sit ahead of whatever is written next.
+// See bufferedResponseWriter.
+func (w *jsonResponseWriter) resetBuf() { w.buf.Reset(w.ResponseWriter) }
+
 type csvResponseWriter struct {
 	statementID int
 	columns     []string
+	buf         *bufio.Writer
+	stats       *responseStats
 	http.ResponseWriter
 }
 
+// newCSVResponseWriter returns a csvResponseWriter whose writes pass
+// through a bufio.Writer of the given size rather than going straight to
+// the socket.
+func newCSVResponseWriter(w http.ResponseWriter, bufSize int, stats *responseStats) *csvResponseWriter {
+	return &csvResponseWriter{statementID: -1, ResponseWriter: w, buf: bufio.NewWriterSize(w, bufSize), stats: stats}
+}
+
+// Finalize sets the Influx-Query-Error/Rows-Written/Statement-Errors
+// trailers from the stats accumulated while writing the response.
+func (w *csvResponseWriter) Finalize() { w.stats.Finalize() }
+
+// Write writes through the output buffer instead of straight to the
+// socket; call Flush to drain it.
+func (w *csvResponseWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
 func (w *csvResponseWriter) WriteResponse(resp Response) (n int, err error) {
+	w.stats.observe(resp)
+
 	csv := csv.NewWriter(writer{Writer: w, n: &n})
 	defer csv.Flush()
 	for _, result := range resp.Results {
@@ -158,12 +247,29 @@ func (w *csvResponseWriter) WriteResponse(resp Response) (n int, err error) {
 	return n, nil
 }
 
+// Flush drains the output buffer and then flushes the underlying
+// ResponseWriter if it has a Flush() method.
 func (w *csvResponseWriter) Flush() {
+	w.buf.Flush()
 	if w, ok := w.ResponseWriter.(http.Flusher); ok {
 		w.Flush()
 	}
 }
 
+// Close finalizes the ResponseWriter if it has a Close() method, e.g. to
+// flush a negotiated content-encoding's trailing frame.
+func (w *csvResponseWriter) Close() error {
+	if w, ok := w.ResponseWriter.(io.Closer); ok {
+		return w.Close()
+	}
+	return nil
+}
+
+// resetBuf discards whatever this response has written but not yet
+// flushed, rather than letting it sit ahead of whatever is written next.
+// See bufferedResponseWriter.
+func (w *csvResponseWriter) resetBuf() { w.buf.Reset(w.ResponseWriter) }
+
 type msgpackTimeExt struct {
 	enc *codec.Encoder
 	buf bytes.Buffer
@@ -200,28 +306,38 @@ func (x *msgpackTimeExt) ReadExt(dst interface{}, src []byte) { panic("unsupport
 
 type msgpackResponseWriter struct {
 	http.ResponseWriter
-	enc *codec.Encoder
-	w   *bufio.Writer
-	n   int
+	h     *codec.MsgpackHandle
+	enc   *codec.Encoder
+	w     *bufio.Writer
+	n     int
+	stats *responseStats
 }
 
-func newMsgpackResponseWriter(rw http.ResponseWriter) *msgpackResponseWriter {
+// newMsgpackResponseWriter returns a msgpackResponseWriter whose output
+// buffer is sized bufSize instead of bufio's 4KiB default.
+func newMsgpackResponseWriter(rw http.ResponseWriter, bufSize int, stats *responseStats) *msgpackResponseWriter {
 	var mh codec.MsgpackHandle
 	mh.WriteExt = true
 	mh.SetBytesExt(reflect.TypeOf(time.Time{}), 1, newMsgpackTimeExt(&mh))
 
-	w := &msgpackResponseWriter{ResponseWriter: rw}
-	w.w = bufio.NewWriter(w.ResponseWriter)
+	w := &msgpackResponseWriter{ResponseWriter: rw, h: &mh, stats: stats}
+	w.w = bufio.NewWriterSize(w.ResponseWriter, bufSize)
 	w.enc = codec.NewEncoder(writer{Writer: w.w, n: &w.n}, &mh)
 	return w
 }
 
 func (w *msgpackResponseWriter) WriteResponse(resp Response) (n int, err error) {
+	w.stats.observe(resp)
+
 	w.n = 0
 	err = w.enc.Encode(resp)
 	return w.n, err
 }
 
+// Finalize sets the Influx-Query-Error/Rows-Written/Statement-Errors
+// trailers from the stats accumulated while writing the response.
+func (w *msgpackResponseWriter) Finalize() { w.stats.Finalize() }
+
 func (w *msgpackResponseWriter) Flush() {
 	w.w.Flush()
 	if w, ok := w.ResponseWriter.(http.Flusher); ok {
@@ -229,6 +345,20 @@ func (w *msgpackResponseWriter) Flush() {
 	}
 }
 
+// resetBuf discards whatever this response has written but not yet
+// flushed, rather than letting it sit ahead of whatever is written next.
+// See bufferedResponseWriter.
+func (w *msgpackResponseWriter) resetBuf() { w.w.Reset(w.ResponseWriter) }
+
+// Close finalizes the ResponseWriter if it has a Close() method, e.g. to
+// flush a negotiated content-encoding's trailing frame.
+func (w *msgpackResponseWriter) Close() error {
+	if w, ok := w.ResponseWriter.(io.Closer); ok {
+		return w.Close()
+	}
+	return nil
+}
+
 type writer struct {
 	io.Writer
 	n *int
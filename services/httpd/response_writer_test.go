@@ -0,0 +1,49 @@
+package httpd
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestResponseWriterBufferSize covers Config.BufferSize / defaultBufferSize
+// wiring in NewResponseWriterWithConfig: an unset (<=0) BufferSize falls
+// back to defaultBufferSize, and a configured one actually sizes the
+// bufio.Writer that jsonResponseWriter/csvResponseWriter/
+// msgpackResponseWriter write through, rather than being ignored.
+func TestResponseWriterBufferSize(t *testing.T) {
+	tests := []struct {
+		name                           string
+		bufferSize                     int
+		writeLen                       int
+		wantFlushedBeforeExplicitFlush bool
+	}{
+		{name: "unset buffer size falls back to the 32KiB default", bufferSize: 0, writeLen: 10, wantFlushedBeforeExplicitFlush: false},
+		{name: "a small configured buffer size auto-flushes once full", bufferSize: 4, writeLen: 100, wantFlushedBeforeExplicitFlush: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/query", nil)
+			r.Header.Set("Accept", "application/csv")
+
+			cfg := NewConfig()
+			cfg.BufferSize = tt.bufferSize
+			cfg.Trailers = false
+			cfg.Push = false
+
+			rw := NewResponseWriterWithConfig(rec, r, cfg)
+			if _, err := rw.Write(bytes.Repeat([]byte("x"), tt.writeLen)); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+
+			gotFlushed := rec.Body.Len() > 0
+			if gotFlushed != tt.wantFlushedBeforeExplicitFlush {
+				t.Errorf("before an explicit Flush, bytes reached the client = %v, want %v (body=%q)",
+					gotFlushed, tt.wantFlushedBeforeExplicitFlush, rec.Body.String())
+			}
+		})
+	}
+}
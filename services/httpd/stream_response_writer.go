@@ -0,0 +1,275 @@
+package httpd
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// StreamConfig controls the flush cadence of WriteResponseStream
+// implementations.
+type StreamConfig struct {
+	// ChunkSize is the number of rows buffered before a writer forces a
+	// Flush, so chunked clients see progress on large results instead of
+	// waiting for the entire multi-statement query to finish.
+	ChunkSize int `toml:"chunk-size"`
+}
+
+// NewStreamConfig returns the package default: flush every 10,000 rows.
+func NewStreamConfig() StreamConfig {
+	return StreamConfig{ChunkSize: 10000}
+}
+
+func (cfg StreamConfig) withDefaults() StreamConfig {
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = NewStreamConfig().ChunkSize
+	}
+	return cfg
+}
+
+// StreamWriter is implemented by ResponseWriters that can encode a
+// Response as its statements become available, rather than requiring the
+// entire Response up front. It is used for chunked=true query requests
+// so a multi-statement query does not have to be buffered in full before
+// the first byte reaches the client.
+type StreamWriter interface {
+	// WriteResponseStream reads *Result values from results until it is
+	// closed, encoding and flushing each as it arrives. It returns once
+	// results is closed, ctx is done, or an encoding error occurs.
+	//
+	// For msgpackResponseWriter this is a wire-format change, not just a
+	// flush-cadence one - see its WriteResponseStream doc comment and
+	// Config.Stream.
+	WriteResponseStream(ctx context.Context, results <-chan *Result, cfg StreamConfig) (int, error)
+}
+
+func (w *jsonResponseWriter) WriteResponseStream(ctx context.Context, results <-chan *Result, cfg StreamConfig) (n int, err error) {
+	cfg = cfg.withDefaults()
+	cw := &writer{Writer: w, n: &n}
+
+	io.WriteString(cw, `{"results":[`)
+	rows, firstResult := 0, true
+	for {
+		select {
+		case <-ctx.Done():
+			return n, ctx.Err()
+		case result, ok := <-results:
+			if !ok {
+				io.WriteString(cw, "]}\n")
+				return n, nil
+			}
+
+			if !firstResult {
+				io.WriteString(cw, ",")
+			}
+			firstResult = false
+			w.stats.observeResult(result)
+
+			if err := writeJSONResult(cw, result, cfg, &rows, w.Flush); err != nil {
+				return n, err
+			}
+		}
+	}
+}
+
+// writeJSONResult encodes a single statement's Result incrementally,
+// emitting each series and row as it is reached instead of marshaling
+// the whole Result at once, and calls flush every cfg.ChunkSize rows.
+func writeJSONResult(cw io.Writer, result *Result, cfg StreamConfig, rows *int, flush func()) error {
+	fmt.Fprintf(cw, `{"statement_id":%d`, result.StatementID)
+	if result.Err != nil {
+		b, _ := json.Marshal(result.Err.Error())
+		fmt.Fprintf(cw, `,"error":%s`, b)
+	}
+
+	io.WriteString(cw, `,"series":[`)
+	for i, series := range result.Series {
+		if i > 0 {
+			io.WriteString(cw, ",")
+		}
+		if err := writeJSONSeries(cw, series, cfg, rows, flush); err != nil {
+			return err
+		}
+	}
+	io.WriteString(cw, "]")
+
+	if result.Partial {
+		io.WriteString(cw, `,"partial":true`)
+	}
+	io.WriteString(cw, "}")
+	return nil
+}
+
+func writeJSONSeries(cw io.Writer, series *models.Row, cfg StreamConfig, rows *int, flush func()) error {
+	name, _ := json.Marshal(series.Name)
+	fmt.Fprintf(cw, `{"name":%s`, name)
+	if len(series.Tags) > 0 {
+		tags, _ := json.Marshal(series.Tags)
+		fmt.Fprintf(cw, `,"tags":%s`, tags)
+	}
+	columns, _ := json.Marshal(series.Columns)
+	fmt.Fprintf(cw, `,"columns":%s,"values":[`, columns)
+
+	for i, value := range series.Values {
+		if i > 0 {
+			io.WriteString(cw, ",")
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		cw.Write(b)
+
+		if *rows++; *rows >= cfg.ChunkSize {
+			*rows = 0
+			flush()
+		}
+	}
+	io.WriteString(cw, "]}")
+	return nil
+}
+
+func (w *csvResponseWriter) WriteResponseStream(ctx context.Context, results <-chan *Result, cfg StreamConfig) (n int, err error) {
+	cfg = cfg.withDefaults()
+	csvw := csv.NewWriter(writer{Writer: w, n: &n})
+	rows := 0
+
+	for {
+		select {
+		case <-ctx.Done():
+			return n, ctx.Err()
+		case result, ok := <-results:
+			if !ok {
+				csvw.Flush()
+				return n, csvw.Error()
+			}
+			w.stats.observeResult(result)
+			if err := w.writeCSVResult(csvw, result); err != nil {
+				return n, err
+			}
+
+			for _, series := range result.Series {
+				rows += len(series.Values)
+			}
+			if rows >= cfg.ChunkSize {
+				rows = 0
+				csvw.Flush()
+				if err := csvw.Error(); err != nil {
+					return n, err
+				}
+				w.Flush()
+			}
+		}
+	}
+}
+
+// writeCSVResult is the per-statement body of csvResponseWriter.WriteResponse,
+// factored out so it can be driven either from a complete Response or, for
+// streaming, one Result at a time off a channel.
+func (w *csvResponseWriter) writeCSVResult(csvw *csv.Writer, result *Result) error {
+	if result.StatementID != w.statementID {
+		if len(result.Series) == 0 {
+			return nil
+		}
+
+		if w.statementID >= 0 {
+			csvw.Flush()
+			if err := csvw.Error(); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+		w.statementID = result.StatementID
+
+		w.columns = make([]string, 2+len(result.Series[0].Columns))
+		w.columns[0] = "name"
+		w.columns[1] = "tags"
+		copy(w.columns[2:], result.Series[0].Columns)
+		if err := csvw.Write(w.columns); err != nil {
+			return err
+		}
+	}
+
+	for _, row := range result.Series {
+		w.columns[0] = row.Name
+		if len(row.Tags) > 0 {
+			w.columns[1] = string(models.Tags(row.Tags).HashKey()[1:])
+		} else {
+			w.columns[1] = ""
+		}
+		for _, values := range row.Values {
+			for i, value := range values {
+				switch v := value.(type) {
+				case float64:
+					w.columns[i+2] = strconv.FormatFloat(v, 'f', -1, 64)
+				case int64:
+					w.columns[i+2] = strconv.FormatInt(v, 10)
+				case string:
+					w.columns[i+2] = v
+				case bool:
+					if v {
+						w.columns[i+2] = "true"
+					} else {
+						w.columns[i+2] = "false"
+					}
+				case time.Time:
+					w.columns[i+2] = strconv.FormatInt(v.UnixNano(), 10)
+				}
+			}
+			csvw.Write(w.columns)
+		}
+	}
+	return nil
+}
+
+// WriteResponseStream encodes each Result as it arrives instead of
+// buffering the whole Response, the same incremental approach the
+// JSON/CSV streamers in this file use. Unlike those text formats,
+// msgpack's array/map headers are length-prefixed - the header bytes
+// themselves encode the element count, so they can't be written until
+// every element is known - which rules out opening a single top-level
+// "results" array the way `{"results":[` can simply be written as a
+// literal prefix in JSON. Instead each Result is written as its own
+// top-level msgpack value, back-to-back on the wire: a streaming client
+// decodes repeatedly from the connection until it's closed, rather than
+// decoding one top-level "results" array the way WriteResponse's
+// non-streaming output must be.
+func (w *msgpackResponseWriter) WriteResponseStream(ctx context.Context, results <-chan *Result, cfg StreamConfig) (n int, err error) {
+	cfg = cfg.withDefaults()
+	rows := 0
+
+	for {
+		select {
+		case <-ctx.Done():
+			return n, ctx.Err()
+		case result, ok := <-results:
+			if !ok {
+				return n, nil
+			}
+
+			w.stats.observeResult(result)
+
+			w.n = 0
+			if err := w.enc.Encode(result); err != nil {
+				return n, err
+			}
+			n += w.n
+
+			for _, series := range result.Series {
+				rows += len(series.Values)
+			}
+			if rows >= cfg.ChunkSize {
+				rows = 0
+				w.Flush()
+			}
+		}
+	}
+}
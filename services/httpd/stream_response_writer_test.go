@@ -0,0 +1,69 @@
+package httpd
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+func TestWriteJSONResult(t *testing.T) {
+	result := &Result{
+		StatementID: 1,
+		Series: []*models.Row{
+			{
+				Name:    "cpu",
+				Tags:    map[string]string{"host": "server01"},
+				Columns: []string{"time", "value"},
+				Values: [][]interface{}{
+					{time.Unix(0, 0), 1.5},
+					{time.Unix(0, 1), 2.5},
+				},
+			},
+		},
+		Partial: true,
+	}
+
+	var buf bytes.Buffer
+	rows, flushed := 0, 0
+	err := writeJSONResult(&buf, result, StreamConfig{ChunkSize: 1}, &rows, func() { flushed++ })
+	if err != nil {
+		t.Fatalf("writeJSONResult() error = %v", err)
+	}
+
+	got := buf.String()
+	for _, want := range []string{
+		`"statement_id":1`,
+		`"name":"cpu"`,
+		`"tags":{"host":"server01"}`,
+		`"columns":["time","value"]`,
+		`"partial":true`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output %q does not contain %q", got, want)
+		}
+	}
+
+	// Two rows flushed one at a time (ChunkSize: 1) should flush twice.
+	if flushed != 2 {
+		t.Errorf("flush called %d times, want 2", flushed)
+	}
+}
+
+func TestWriteJSONResult_error(t *testing.T) {
+	result := &Result{StatementID: 0, Err: errors.New("boom")}
+
+	var buf bytes.Buffer
+	rows := 0
+	if err := writeJSONResult(&buf, result, StreamConfig{ChunkSize: 1}, &rows, func() {}); err != nil {
+		t.Fatalf("writeJSONResult() error = %v", err)
+	}
+
+	got := buf.String()
+	if !strings.Contains(got, `"error":"boom"`) {
+		t.Errorf("output %q does not contain the result error", got)
+	}
+}
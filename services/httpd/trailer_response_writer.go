@@ -0,0 +1,124 @@
+package httpd
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// HTTP/2 response trailers populated once a query's results have been
+// fully encoded, so a client can learn whether (and how) a multi-
+// statement query errored without waiting to parse the whole body.
+const (
+	trailerQueryError      = "Influx-Query-Error"
+	trailerRowsWritten     = "Influx-Rows-Written"
+	trailerStatementErrors = "Influx-Statement-Errors"
+)
+
+// Finalizer is implemented by ResponseWriters that accumulate trailer
+// stats while encoding a Response. The handler calls Finalize once,
+// after the last call to WriteResponse or WriteResponseStream and after
+// its own final Flush, so that an HTTP/2 client has already processed
+// the body its trailers describe.
+type Finalizer interface {
+	Finalize()
+}
+
+// responseStats accumulates the counters a ResponseWriter reports as
+// trailers once Finalize is called.
+type responseStats struct {
+	w http.ResponseWriter
+
+	queryError      string
+	rowsWritten     int
+	statementErrors int
+}
+
+// observe folds resp's outcome into the accumulated stats.
+func (s *responseStats) observe(resp Response) {
+	if resp.Err != nil {
+		s.queryError = resp.Err.Error()
+	}
+	for i := range resp.Results {
+		s.observeResult(&resp.Results[i])
+	}
+}
+
+// observeResult folds a single statement's outcome into the accumulated
+// stats. It is the streaming counterpart to observe, called once per
+// Result as it arrives off a WriteResponseStream channel instead of once
+// for the whole Response, so it must add to, not overwrite, the row and
+// error counts.
+func (s *responseStats) observeResult(result *Result) {
+	if result.Err != nil {
+		s.statementErrors++
+	}
+	for _, series := range result.Series {
+		s.rowsWritten += len(series.Values)
+	}
+}
+
+// declareTrailers names the trailer keys that Finalize will later set.
+// Per the net/http trailer contract these must be declared via the
+// Trailer header before the first Write, so this runs from
+// NewResponseWriterWithConfig rather than from Finalize itself.
+func declareTrailers(w http.ResponseWriter) {
+	h := w.Header()
+	h.Add("Trailer", trailerQueryError)
+	h.Add("Trailer", trailerRowsWritten)
+	h.Add("Trailer", trailerStatementErrors)
+}
+
+// Finalize sets the trailers declared by declareTrailers from the
+// accumulated stats.
+func (s *responseStats) Finalize() {
+	if s.w == nil {
+		return
+	}
+	h := s.w.Header()
+	h.Set(trailerQueryError, s.queryError)
+	h.Set(trailerRowsWritten, strconv.Itoa(s.rowsWritten))
+	h.Set(trailerStatementErrors, strconv.Itoa(s.statementErrors))
+}
+
+// PushFieldKeys issues an HTTP/2 server push of a "SHOW FIELD KEYS"
+// companion request for each of measurements, so a dashboard that will
+// need them for the primary query's results doesn't have to wait for a
+// second round trip. It is a no-op, not an error, if cfg.Push is
+// disabled or w doesn't implement http.Pusher - an HTTP/1.1 connection,
+// or an h2 intermediary that strips PUSH_PROMISE, for instance.
+//
+// Callers are expected to have already pulled measurements out of the
+// primary query (e.g. from its parsed FROM clauses); this package only
+// owns the push mechanics, not InfluxQL parsing.
+func PushFieldKeys(w http.ResponseWriter, r *http.Request, db string, measurements []string, cfg Config) {
+	if !cfg.Push || len(measurements) == 0 {
+		return
+	}
+	pusher, ok := w.(http.Pusher)
+	if !ok {
+		return
+	}
+
+	for _, m := range measurements {
+		q := fmt.Sprintf(`SHOW FIELD KEYS FROM %s`, quoteIdent(m))
+		target := fmt.Sprintf("/query?%s", url.Values{"db": {db}, "q": {q}}.Encode())
+		// Errors are expected and ignored: a client that doesn't want
+		// the push (or a proxy that doesn't support it) rejects the
+		// PUSH_PROMISE, which isn't a failure of the primary response.
+		_ = pusher.Push(target, nil)
+	}
+}
+
+// quoteIdent double-quotes s for use as an InfluxQL identifier, escaping
+// embedded backslashes and double quotes so a measurement name (e.g. one
+// containing a literal `"`, legal in line protocol) can't break out of
+// the quoting and inject InfluxQL into the pushed query built by
+// PushFieldKeys.
+func quoteIdent(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
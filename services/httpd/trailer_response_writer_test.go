@@ -0,0 +1,108 @@
+package httpd
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+func TestQuoteIdent(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "plain", in: "cpu", want: `"cpu"`},
+		{name: "embedded double quote", in: `cpu"load`, want: `"cpu\"load"`},
+		{name: "embedded backslash", in: `cpu\load`, want: `"cpu\\load"`},
+		{
+			name: "crafted name with embedded quotes does not close early",
+			in:   `cpu" OR "1"="1`,
+			want: `"cpu\" OR \"1\"=\"1"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quoteIdent(tt.in); got != tt.want {
+				t.Errorf("quoteIdent(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseStats_Finalize(t *testing.T) {
+	rec := httptest.NewRecorder()
+	declareTrailers(rec)
+
+	stats := &responseStats{w: rec}
+	stats.observe(Response{
+		Results: []Result{
+			{StatementID: 0, Series: []*models.Row{{Name: "cpu", Values: [][]interface{}{{1}, {2}}}}},
+			{StatementID: 1, Err: errors.New("boom")},
+		},
+	})
+	stats.Finalize()
+
+	h := rec.Header()
+	if got := h.Get(trailerRowsWritten); got != "2" {
+		t.Errorf("%s = %q, want %q", trailerRowsWritten, got, "2")
+	}
+	if got := h.Get(trailerStatementErrors); got != "1" {
+		t.Errorf("%s = %q, want %q", trailerStatementErrors, got, "1")
+	}
+	if got := h.Get(trailerQueryError); got != "" {
+		t.Errorf("%s = %q, want empty (no top-level Response.Err)", trailerQueryError, got)
+	}
+}
+
+func TestResponseStats_Finalize_noResponseWriter(t *testing.T) {
+	// Finalize must be a no-op, not a nil-pointer panic, when Trailers
+	// was never enabled (responseStats.w left unset).
+	stats := &responseStats{}
+	stats.Finalize()
+}
+
+func TestPushFieldKeys_disabled(t *testing.T) {
+	rec := &fakePusher{ResponseWriter: httptest.NewRecorder()}
+	r := httptest.NewRequest(http.MethodGet, "/query", nil)
+
+	// cfg.Push is false: must not push even though rec implements
+	// http.Pusher.
+	PushFieldKeys(rec, r, "mydb", []string{"cpu"}, Config{Push: false})
+
+	if len(rec.pushed) != 0 {
+		t.Fatalf("pushed %d targets with Push disabled, want 0: %v", len(rec.pushed), rec.pushed)
+	}
+}
+
+type fakePusher struct {
+	http.ResponseWriter
+	pushed []string
+}
+
+func (p *fakePusher) Push(target string, opts *http.PushOptions) error {
+	p.pushed = append(p.pushed, target)
+	return nil
+}
+
+func TestPushFieldKeys(t *testing.T) {
+	rec := &fakePusher{ResponseWriter: httptest.NewRecorder()}
+	r := httptest.NewRequest(http.MethodGet, "/query", nil)
+
+	PushFieldKeys(rec, r, "mydb", []string{"cpu", `disk" OR 1=1`}, Config{Push: true})
+
+	if len(rec.pushed) != 2 {
+		t.Fatalf("pushed %d targets, want 2: %v", len(rec.pushed), rec.pushed)
+	}
+	if !strings.Contains(rec.pushed[0], `SHOW+FIELD+KEYS+FROM+%22cpu%22`) {
+		t.Errorf("pushed[0] = %q, want it to contain the quoted measurement", rec.pushed[0])
+	}
+	if !strings.Contains(rec.pushed[1], `%5C%22`) {
+		t.Errorf("pushed[1] = %q, want the embedded quote escaped, not breaking out of the identifier", rec.pushed[1])
+	}
+}